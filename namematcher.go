@@ -0,0 +1,64 @@
+// Copyright 2010 Brad Fitzpatrick. All rights reserved. See LICENSE file.
+//
+// namematcher.go is a small pattern list used by the --include-*/
+// --exclude-* flags to match gallery titles/keys and pic MIME types.
+
+package main
+
+import "strings"
+
+// NameList is a set of comma-separated patterns.  A pattern is
+// matched case-insensitively; a single leading and/or trailing "*" is
+// a wildcard, anything else requires an exact match.
+type NameList []string
+
+func newNameList(csv string) NameList {
+	if csv == "" {
+		return nil
+	}
+	return NameList(strings.Split(csv, ","))
+}
+
+func (l NameList) Empty() bool {
+	return len(l) == 0
+}
+
+func (l NameList) MatchesAny(candidates ...string) bool {
+	for _, c := range candidates {
+		if l.Matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l NameList) Matches(name string) bool {
+	name = strings.ToLower(name)
+	for _, pat := range l {
+		pat = strings.ToLower(strings.TrimSpace(pat))
+		if pat == "" {
+			continue
+		}
+		prefix := strings.HasPrefix(pat, "*")
+		suffix := strings.HasSuffix(pat, "*")
+		switch {
+		case prefix && suffix && len(pat) > 1:
+			if strings.Contains(name, pat[1:len(pat)-1]) {
+				return true
+			}
+		case prefix:
+			if strings.HasSuffix(name, pat[1:]) {
+				return true
+			}
+		case suffix:
+			if strings.HasPrefix(name, pat[0:len(pat)-1]) {
+				return true
+			}
+		default:
+			if name == pat {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+// Copyright 2010 Brad Fitzpatrick. All rights reserved. See LICENSE file.
+
+package main
+
+import "testing"
+
+func TestNameListMatches(t *testing.T) {
+	cases := []struct {
+		csv  string
+		name string
+		want bool
+	}{
+		{"", "anything", false},
+		{"vacation", "Vacation", true},
+		{"vacation", "vacations", false},
+		{"vacation*", "VacationPhotos", true},
+		{"*photos", "MyPhotos", true},
+		{"*2010*", "summer2010trip", true},
+		{"*", "", true},
+		{"foo, bar", "bar", true},
+		{"foo, bar", "baz", false},
+	}
+	for _, c := range cases {
+		l := newNameList(c.csv)
+		if got := l.Matches(c.name); got != c.want {
+			t.Errorf("newNameList(%q).Matches(%q) = %v, want %v", c.csv, c.name, got, c.want)
+		}
+	}
+}
+
+func TestNameListEmpty(t *testing.T) {
+	if !newNameList("").Empty() {
+		t.Errorf("newNameList(\"\").Empty() = false, want true")
+	}
+	if newNameList("x").Empty() {
+		t.Errorf("newNameList(\"x\").Empty() = true, want false")
+	}
+}
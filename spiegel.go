@@ -13,13 +13,21 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
 	"flag"
 	"fmt"
+	"hash"
 	"http"
+	"io"
 	"io/ioutil"
+	"json"
 	"log"
 	"os"
+	"rand"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"xml"
@@ -38,12 +46,534 @@ var flagMaxNetwork *int = flag.Int("concurrency", 20, "Max concurrent requests")
 var flagProfile *string = flag.String("profile", "",
 	"the listen address to run a webserver for profiling; empty to leave disabled")
 
+var flagRefresh *string = flag.String("refresh", "",
+	"re-fetch XML whose manifest entry is older than this (e.g. \"24h\"); empty means never re-fetch")
+
+var flagQuiet *bool = flag.Bool("quiet", false,
+	"Log-only mode; don't draw the progress display (use for non-TTY runs)")
+
+var flagIncludeGallery *string = flag.String("include-gallery", "",
+	"comma-separated patterns (key or title, trailing/leading * wildcard ok); if set, only matching galleries are mirrored")
+var flagExcludeGallery *string = flag.String("exclude-gallery", "",
+	"comma-separated patterns (key or title) of galleries to skip")
+var flagIncludeMime *string = flag.String("include-mime", "",
+	"comma-separated patterns; if set, only pics whose mime type matches are fetched")
+var flagMinBytes *int64 = flag.Int64("min-bytes", -1, "skip pics smaller than this many bytes; -1 means no minimum")
+var flagMaxBytes *int64 = flag.Int64("max-bytes", -1, "skip pics larger than this many bytes; -1 means no maximum")
+
+var flagMaxRetries *int = flag.Int("max-retries", 5,
+	"Max attempts for a transient fetch error (network error, 5xx, 429) before giving up")
+var flagRate *string = flag.String("rate", "",
+	"Max requests/sec per host, e.g. \"5\" or \"0.5\"; empty means unlimited")
+
+var includeGalleryList NameList
+var excludeGalleryList NameList
+var includeMimeList NameList
+
 var galleryMutex sync.Mutex
 var galleryMap map[string]*Gallery = make(map[string]*Gallery)
 
+// galleryFetching holds the keys of galleries with a Gallery.Fetch
+// currently in flight (including mid-backoff retries), guarded by
+// galleryMutex, so noteGallery and apiRetry never launch a second
+// concurrent fetch for the same key: both would race on the same
+// ".tmp" file.
+var galleryFetching map[string]bool = make(map[string]bool)
+
 var picMutex sync.Mutex
 var picMap map[string]*MediaSetItem = make(map[string]*MediaSetItem)
 
+// picFetching is galleryFetching's pic-side counterpart, guarded by
+// picMutex.
+var picFetching map[string]bool = make(map[string]bool)
+
+// digestMutex guards digestIndex, the known-blobs index of the
+// content-addressable store rooted at blobsDir().  It maps
+// "type:value" (e.g. "sha1:abcd...") to the blob's size in bytes, and
+// is populated lazily by scanning the existing tree on startup so
+// that a blob already backed up under any gallery is never
+// re-downloaded.
+var digestMutex sync.Mutex
+var digestIndex map[string]int64 = make(map[string]int64)
+
+// Progress-display state.  xmlBacklog counts Gallery/MediaSetItem
+// fetches that have been queued but haven't finished; bytesDoneTotal is
+// bytes of blob/XML content actually read off the wire so far;
+// transfers holds one entry per in-flight HTTP body, which is
+// naturally capped at --concurrency since only network fetches
+// register one.
+var progressMutex sync.Mutex
+var xmlBacklog int
+var bytesDoneTotal int64
+var pageMutex sync.Mutex
+var currentPage int
+
+var transfersMutex sync.Mutex
+var transfers map[int]*transferProgress = make(map[int]*transferProgress)
+var nextTransferId int
+
+type transferProgress struct {
+	url   string
+	have  int64
+	total int64 // -1 if unknown
+}
+
+func incBacklog() {
+	progressMutex.Lock()
+	xmlBacklog++
+	progressMutex.Unlock()
+}
+
+func decBacklog() {
+	progressMutex.Lock()
+	xmlBacklog--
+	progressMutex.Unlock()
+}
+
+func getBacklog() int {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	return xmlBacklog
+}
+
+func addBytesDone(n int64) {
+	progressMutex.Lock()
+	bytesDoneTotal += n
+	progressMutex.Unlock()
+}
+
+func getBytesDone() int64 {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	return bytesDoneTotal
+}
+
+func setCurrentPage(page int) {
+	pageMutex.Lock()
+	currentPage = page
+	pageMutex.Unlock()
+}
+
+func getCurrentPage() int {
+	pageMutex.Lock()
+	defer pageMutex.Unlock()
+	return currentPage
+}
+
+func bytesTotal() int64 {
+	picMutex.Lock()
+	defer picMutex.Unlock()
+	var total int64
+	for _, p := range picMap {
+		if p.File.Bytes > 0 {
+			total += p.File.Bytes
+		}
+	}
+	return total
+}
+
+// beginTransfer registers a new in-flight HTTP body for the progress
+// display and returns its id; endTransfer removes it once the
+// transfer is done (success or failure).
+func beginTransfer(url string, total int64) int {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	nextTransferId++
+	id := nextTransferId
+	transfers[id] = &transferProgress{url: url, total: total}
+	return id
+}
+
+func bumpTransfer(id int, delta int64) {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	if t, ok := transfers[id]; ok {
+		t.have += delta
+	}
+}
+
+func endTransfer(id int) {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	transfers[id] = nil, false
+}
+
+// progressReader wraps an io.Reader, ticking the aggregate bytes-done
+// counter and its transfer's own progress as bytes are actually read
+// off the wire.  Using this instead of ioutil.ReadAll means a large
+// image never needs to live in memory all at once.
+type progressReader struct {
+	r  io.Reader
+	id int
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err os.Error) {
+	n, err = pr.r.Read(p)
+	if n > 0 {
+		addBytesDone(int64(n))
+		bumpTransfer(pr.id, int64(n))
+	}
+	return
+}
+
+// progressLoop redraws the multi-bar progress display every half
+// second until the process exits.  main doesn't start it under
+// --quiet, where the existing log.Printf chatter is used instead.
+func progressLoop() {
+	for {
+		time.Sleep(500 * 1e6)
+		printProgress()
+	}
+}
+
+var progressLinesPrinted int
+
+func printProgress() {
+	lines := buildProgressLines()
+	if progressLinesPrinted > 0 {
+		fmt.Printf("\x1b[%dA", progressLinesPrinted)
+	}
+	for _, line := range lines {
+		fmt.Printf("\x1b[K%s\n", line)
+	}
+	progressLinesPrinted = len(lines)
+}
+
+func buildProgressLines() []string {
+	lines := make([]string, 0, 4+*flagMaxNetwork)
+	lines = append(lines, fmt.Sprintf("Gallery pages: page %d, %d galleries known",
+		getCurrentPage(), knownGalleries()))
+	lines = append(lines, fmt.Sprintf("XML backlog: %d pending", getBacklog()))
+	lines = append(lines, fmt.Sprintf("Bytes: %d/%d", getBytesDone(), bytesTotal()))
+
+	transfersMutex.Lock()
+	for id, t := range transfers {
+		lines = append(lines, fmt.Sprintf("  [%d] %d/%d %s", id, t.have, t.total, t.url))
+	}
+	transfersMutex.Unlock()
+	return lines
+}
+
+// The manifest is a JSON catalog of every gallery and pic ever seen,
+// persisted under --dest so an interrupted run can resume without
+// re-crawling pages or blobs it already knows are satisfied.
+type ManifestGalleryEntry struct {
+	Key         string
+	XmlUrl      string
+	LastFetched int64 // unix seconds; 0 if never successfully fetched
+	Parents     []string
+	Children    []string
+	Excluded    bool // skipped by --include-gallery/--exclude-gallery
+	Gone        bool // got a permanent (e.g. 404/410) error; not retried again
+}
+
+type ManifestPicEntry struct {
+	Key         string
+	XmlUrl      string
+	LastFetched int64 // unix seconds; 0 if never successfully fetched
+	DigestType  string
+	DigestValue string
+	Bytes       int64
+	Excluded    bool // skipped by --include-mime/--min-bytes/--max-bytes
+	Gone        bool // got a permanent (e.g. 404/410) error; not retried again
+}
+
+type Manifest struct {
+	Galleries map[string]*ManifestGalleryEntry
+	Pics      map[string]*ManifestPicEntry
+}
+
+var manifestMutex sync.Mutex
+var manifest *Manifest = &Manifest{
+	Galleries: make(map[string]*ManifestGalleryEntry),
+	Pics:      make(map[string]*ManifestPicEntry),
+}
+
+func manifestPath() string {
+	return fmt.Sprintf("%s/manifest.json", *flagDest)
+}
+
+// loadManifest reads the on-disk manifest, if any, and seeds
+// galleryMap/picMap from it so a resumed run already knows about
+// everything a prior run discovered.
+func loadManifest() {
+	data, err := ioutil.ReadFile(manifestPath())
+	if err != nil {
+		return // no manifest yet; starting fresh
+	}
+	m := &Manifest{
+		Galleries: make(map[string]*ManifestGalleryEntry),
+		Pics:      make(map[string]*ManifestPicEntry),
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		addError(fmt.Sprintf("Error parsing manifest %s: %v", manifestPath(), err))
+		return
+	}
+
+	manifestMutex.Lock()
+	manifest = m
+	manifestMutex.Unlock()
+
+	galleryMutex.Lock()
+	for key, _ := range m.Galleries {
+		galleryMap[key] = &Gallery{key}
+	}
+	galleryMutex.Unlock()
+
+	picMutex.Lock()
+	for key, e := range m.Pics {
+		picMap[key] = &MediaSetItem{
+			key:  key,
+			File: MediaFile{Digest: DigestInfo{Type: e.DigestType, Value: e.DigestValue}, Bytes: e.Bytes},
+		}
+	}
+	picMutex.Unlock()
+}
+
+// saveManifestMutex serializes saveManifest's marshal-write-rename
+// sequence across the many concurrent fetch-completion goroutines
+// that call it, so two callers never race on the shared ".tmp" path
+// or commit out of order (an older in-memory snapshot renamed into
+// place after a newer one).
+var saveManifestMutex sync.Mutex
+
+// saveManifest persists the in-memory manifest to disk.  It's called
+// after every update, which is simple and plenty fast for a tool
+// whose bottleneck is the network, not the filesystem.
+func saveManifest() {
+	saveManifestMutex.Lock()
+	defer saveManifestMutex.Unlock()
+
+	manifestMutex.Lock()
+	data, err := json.Marshal(manifest)
+	manifestMutex.Unlock()
+	if err != nil {
+		addError(fmt.Sprintf("Error encoding manifest: %v", err))
+		return
+	}
+	tmpName := manifestPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		addError(fmt.Sprintf("Error writing manifest %s: %v", tmpName, err))
+		return
+	}
+	if err := os.Rename(tmpName, manifestPath()); err != nil {
+		addError(fmt.Sprintf("Error committing manifest %s: %v", manifestPath(), err))
+	}
+}
+
+func galleryLastFetched(key string) int64 {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if e, ok := manifest.Galleries[key]; ok {
+		return e.LastFetched
+	}
+	return 0
+}
+
+func noteGalleryFetched(key, xmlUrl string) {
+	manifestMutex.Lock()
+	e, ok := manifest.Galleries[key]
+	if !ok {
+		e = &ManifestGalleryEntry{Key: key, XmlUrl: xmlUrl}
+		manifest.Galleries[key] = e
+	}
+	e.LastFetched = time.Seconds()
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+func picLastFetched(key string) int64 {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if e, ok := manifest.Pics[key]; ok {
+		return e.LastFetched
+	}
+	return 0
+}
+
+func noteGalleryLinks(key string, parents, children []string) {
+	manifestMutex.Lock()
+	e, ok := manifest.Galleries[key]
+	if ok {
+		e.Parents = parents
+		e.Children = children
+	}
+	manifestMutex.Unlock()
+	if ok {
+		saveManifest()
+	}
+}
+
+// markGalleryExcluded records that key was skipped by
+// --include-gallery/--exclude-gallery, without touching LastFetched,
+// so a later run with different filters still tries to fetch it.
+func markGalleryExcluded(key, xmlUrl string) {
+	manifestMutex.Lock()
+	e, ok := manifest.Galleries[key]
+	if !ok {
+		e = &ManifestGalleryEntry{Key: key, XmlUrl: xmlUrl}
+		manifest.Galleries[key] = e
+	}
+	e.Excluded = true
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+func galleryExcluded(key string) bool {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if e, ok := manifest.Galleries[key]; ok {
+		return e.Excluded
+	}
+	return false
+}
+
+// markPicExcluded records that pic was skipped by --include-mime,
+// --min-bytes or --max-bytes, without touching LastFetched, so a
+// later run with different filters still tries to fetch it.
+func markPicExcluded(pic *MediaSetItem) {
+	manifestMutex.Lock()
+	e, ok := manifest.Pics[pic.key]
+	if !ok {
+		e = &ManifestPicEntry{Key: pic.key, XmlUrl: pic.XmlUrl()}
+		manifest.Pics[pic.key] = e
+	}
+	e.Excluded = true
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+// markGalleryGone/markPicGone record a permanent fetch failure: any
+// 4xx other than 429 (see classifiedGet), or, for a pic, a blob whose
+// digest type can't be verified.  Unlike Excluded, Gone is never
+// reconsidered.
+func markGalleryGone(key string) {
+	manifestMutex.Lock()
+	e, ok := manifest.Galleries[key]
+	if !ok {
+		e = &ManifestGalleryEntry{Key: key}
+		manifest.Galleries[key] = e
+	}
+	e.Gone = true
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+func galleryGone(key string) bool {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if e, ok := manifest.Galleries[key]; ok {
+		return e.Gone
+	}
+	return false
+}
+
+func markPicGone(key string) {
+	manifestMutex.Lock()
+	e, ok := manifest.Pics[key]
+	if !ok {
+		e = &ManifestPicEntry{Key: key}
+		manifest.Pics[key] = e
+	}
+	e.Gone = true
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+func picGone(key string) bool {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if e, ok := manifest.Pics[key]; ok {
+		return e.Gone
+	}
+	return false
+}
+
+func notePicFetched(pic *MediaSetItem) {
+	manifestMutex.Lock()
+	e, ok := manifest.Pics[pic.key]
+	if !ok {
+		e = &ManifestPicEntry{Key: pic.key, XmlUrl: pic.XmlUrl()}
+		manifest.Pics[pic.key] = e
+	}
+	e.LastFetched = time.Seconds()
+	e.DigestType = pic.File.Digest.Type
+	e.DigestValue = pic.File.Digest.Value
+	e.Bytes = pic.File.Bytes
+	manifestMutex.Unlock()
+	saveManifest()
+}
+
+// freshEnough reports whether a manifest entry last fetched at
+// lastFetched (unix seconds, 0 meaning "never") is still within
+// --refresh of now.  An empty --refresh means entries never expire.
+func freshEnough(lastFetched int64) bool {
+	if lastFetched == 0 {
+		return false
+	}
+	if *flagRefresh == "" {
+		return true
+	}
+	return time.Seconds()-lastFetched < parseDuration(*flagRefresh)
+}
+
+// galleryAllowed reports whether a gallery with the given key and
+// (possibly still-unknown, i.e. "") title should be mirrored at all,
+// per --include-gallery/--exclude-gallery.
+func galleryAllowed(key, title string) bool {
+	if excludeGalleryList.MatchesAny(key, title) {
+		return false
+	}
+	if !includeGalleryList.Empty() && !includeGalleryList.MatchesAny(key, title) {
+		return false
+	}
+	return true
+}
+
+// picAllowed reports whether a pic with the given mime type and size
+// should be fetched, per --include-mime/--min-bytes/--max-bytes.
+func picAllowed(mime string, size int64) bool {
+	if !includeMimeList.Empty() && !includeMimeList.Matches(mime) {
+		return false
+	}
+	if *flagMinBytes >= 0 && size < *flagMinBytes {
+		return false
+	}
+	if *flagMaxBytes >= 0 && size > *flagMaxBytes {
+		return false
+	}
+	return true
+}
+
+// parseDuration parses a simple "<n><unit>" duration, where unit is
+// one of s, m, h, or d (seconds, minutes, hours, days); no unit means
+// seconds.
+func parseDuration(s string) int64 {
+	if len(s) == 0 {
+		return 0
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 's':
+		mult = 1
+	case 'm':
+		mult = 60
+	case 'h':
+		mult = 3600
+	case 'd':
+		mult = 86400
+	default:
+		n, _ := strconv.Atoi(s)
+		return int64(n)
+	}
+	n, _ := strconv.Atoi(s[0 : len(s)-1])
+	return int64(n) * mult
+}
+
+// gateMutex guards networkOpGate itself (not its contents), so
+// resizeNetworkConcurrency can swap in a differently-sized channel on
+// the fly via the control API's POST /concurrency.
+var gateMutex sync.Mutex
 var networkOpGate chan bool
 
 // Consult ulimit -n; you may have to up your
@@ -53,8 +583,18 @@ var localOpGate chan bool = make(chan bool, 10000)
 var opsMutex sync.Mutex
 var opsInFlight int
 
+// FetchError is one entry of the structured error log served by the
+// control API's GET /errors.  URL is empty for errors that aren't
+// about fetching a particular URL (e.g. a manifest write failure).
+type FetchError struct {
+	URL      string
+	Status   int // HTTP status, or 0 if not an HTTP-status error
+	Attempts int
+	LastErr  string
+}
+
 var errorMutex sync.Mutex
-var errors []string = make([]string, 0)
+var errors []FetchError = make([]FetchError, 0)
 
 var galleryPattern *regexp.Regexp = regexp.MustCompile(
 	"/gallery/([0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z])")
@@ -62,23 +602,58 @@ var picPattern *regexp.Regexp = regexp.MustCompile(
 	"/pic/([0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z][0-9a-z])")
 
 func addError(msg string) {
-	errorMutex.Lock()
-	defer errorMutex.Unlock()
-	errors = append(errors, msg)
+	addFetchError("", 0, 1, msg)
+}
+
+func addFetchError(url string, status, attempts int, lastErr string) {
+	recordFetchError(url, status, attempts, lastErr)
 	if *flagSloppy {
-		log.Printf("ERROR: %s", msg)
+		log.Printf("ERROR: %s (status=%d attempts=%d): %s", url, status, attempts, lastErr)
 	} else {
-		log.Exitf("ERROR: %s", msg)
+		log.Exitf("ERROR: %s (status=%d attempts=%d): %s", url, status, attempts, lastErr)
 	}
 }
 
+// addTransientFetchError records a single failed attempt.  Unlike
+// addFetchError, it never calls log.Exitf: a lone 503 or timeout on
+// attempt 1 isn't grounds to kill the whole run when --max-retries
+// hasn't even been reached yet.  The caller then retries with backoff,
+// marks a permanent failure as gone, or, after --max-retries attempts,
+// gives up for good through addFetchError.
+func addTransientFetchError(url string, status, attempts int, lastErr string) {
+	recordFetchError(url, status, attempts, lastErr)
+	log.Printf("ERROR (retrying): %s (status=%d attempts=%d): %s", url, status, attempts, lastErr)
+}
+
+func recordFetchError(url string, status, attempts int, lastErr string) {
+	errorMutex.Lock()
+	errors = append(errors, FetchError{url, status, attempts, lastErr})
+	errorMutex.Unlock()
+}
+
 type Operation interface {
 	Done()
+
+	// Retry acquires a fresh Operation of the same kind for a
+	// delayed retry of work this one gave up on, without
+	// double-counting OperationsInFlight: the original's Done()
+	// releases its slot when the current call returns, and Retry()
+	// blocks (like NewLocalOperation/NewNetworkOperation) until a
+	// slot is available for the retry goroutine.
+	Retry() Operation
 }
 
-type NetworkOperation int
 type LocalOperation int
 
+// NetworkOperation holds the gate channel it acquired a slot from, so
+// that resizeNetworkConcurrency can swap networkOpGate out for a
+// differently-sized channel without disturbing operations already
+// in flight: each one releases back to the gate it actually
+// acquired, not whatever networkOpGate happens to point to by then.
+type NetworkOperation struct {
+	gate chan bool
+}
+
 func NewLocalOperation() Operation {
 	opsMutex.Lock()
 	opsInFlight++
@@ -91,8 +666,11 @@ func NewNetworkOperation() Operation {
 	opsMutex.Lock()
 	opsInFlight++
 	opsMutex.Unlock()
-	networkOpGate <- true
-	return NetworkOperation(0)
+	gateMutex.Lock()
+	gate := networkOpGate
+	gateMutex.Unlock()
+	gate <- true
+	return &NetworkOperation{gate}
 }
 
 func (o LocalOperation) Done() {
@@ -102,52 +680,385 @@ func (o LocalOperation) Done() {
 	opsInFlight--
 }
 
-func (o NetworkOperation) Done() {
-	<-networkOpGate
+func (o LocalOperation) Retry() Operation {
+	return NewLocalOperation()
+}
+
+func (o *NetworkOperation) Done() {
+	<-o.gate
 	opsMutex.Lock()
 	defer opsMutex.Unlock()
 	opsInFlight--
 }
 
+func (o *NetworkOperation) Retry() Operation {
+	return NewNetworkOperation()
+}
+
 func OperationsInFlight() int {
 	opsMutex.Lock()
 	defer opsMutex.Unlock()
 	return opsInFlight
 }
 
-func fetchUrlToFile(url, filename string, expectedSize int64) bool {
-	fi, statErr := os.Stat(filename)
-	if statErr == nil &&
-		(expectedSize == -1 && fi.Size > 0 ||
-			expectedSize == fi.Size) {
-		// TODO: re-fetch mode?
-		return true
+// resizeNetworkConcurrency changes how many network fetches may run
+// at once.  Only future NewNetworkOperation calls see the new limit;
+// operations already in flight keep draining the gate they acquired.
+func resizeNetworkConcurrency(n int) {
+	gateMutex.Lock()
+	defer gateMutex.Unlock()
+	networkOpGate = make(chan bool, n)
+	*flagMaxNetwork = n
+}
+
+// tokenBucket is a simple per-host rate limiter: requests per second,
+// refilled continuously, so --rate can keep the crawler polite to a
+// single host without lowering --concurrency for everything else.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	rate   float64 // tokens/sec
+	last   int64   // time.Nanoseconds() at last refill
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{tokens: rate, rate: rate, last: time.Nanoseconds()}
+}
+
+func (b *tokenBucket) Wait() {
+	for {
+		b.mutex.Lock()
+		now := time.Nanoseconds()
+		b.tokens += float64(now-b.last) / 1e9 * b.rate
+		// Burst capped at one second's worth, but never below one
+		// token, so rates under 1/sec can still admit a request.
+		burst := b.rate
+		if burst < 1 {
+			burst = 1
+		}
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mutex.Unlock()
+			return
+		}
+		wait := (1 - b.tokens) / b.rate
+		b.mutex.Unlock()
+		time.Sleep(int64(wait * 1e9))
+	}
+}
+
+var rateLimiterMutex sync.Mutex
+var rateLimiters map[string]*tokenBucket = make(map[string]*tokenBucket)
+
+// rateLimiterForHost returns the token bucket for url's host,
+// creating one lazily, or nil if --rate wasn't given (unlimited).
+func rateLimiterForHost(url string) *tokenBucket {
+	if *flagRate == "" {
+		return nil
+	}
+	host := hostOf(url)
+	rateLimiterMutex.Lock()
+	defer rateLimiterMutex.Unlock()
+	rl, ok := rateLimiters[host]
+	if !ok {
+		rate, _ := strconv.Atof64(*flagRate)
+		if rate <= 0 {
+			rate = 1
+		}
+		rl = newTokenBucket(rate)
+		rateLimiters[host] = rl
+	}
+	return rl
+}
+
+// hostOf extracts the host[:port] portion of a URL without pulling
+// in a full URL parser.
+func hostOf(rawurl string) string {
+	s := rawurl
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		s = s[0:i]
+	}
+	return s
+}
+
+// backoffDelay returns a jittered exponential backoff for the given
+// (1-based) attempt number, capped at one minute.
+func backoffDelay(attempt int) int64 {
+	const base = int64(500 * 1e6) // 500ms
+	const max = int64(60 * 1e9)   // 1 minute
+	backoff := base << uint(attempt-1)
+	if backoff <= 0 || backoff > max {
+		backoff = max
+	}
+	return backoff/2 + rand.Int63n(backoff/2+1)
+}
+
+// parseRetryAfter parses an HTTP Retry-After header's value (we only
+// support the seconds form, not the HTTP-date form) into seconds.
+func parseRetryAfter(s string) int64 {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return int64(n)
+}
+
+// blobsDir is the root of the content-addressable store, e.g.
+// "<dest>/blobs".
+func blobsDir() string {
+	return fmt.Sprintf("%s/blobs", *flagDest)
+}
+
+// casPath returns the path a blob with the given digest type (e.g.
+// "sha1") and hex value is stored at, fanned out two levels deep to
+// keep any one directory from growing enormous.
+func casPath(digestType, digestValue string) string {
+	if len(digestValue) < 4 {
+		return fmt.Sprintf("%s/%s/%s", blobsDir(), digestType, digestValue)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", blobsDir(), digestType,
+		digestValue[0:2], digestValue[2:4], digestValue)
+}
+
+func newDigestHash(digestType string) hash.Hash {
+	switch digestType {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+func digestKnown(digestType, digestValue string, size int64) bool {
+	digestMutex.Lock()
+	defer digestMutex.Unlock()
+	knownSize, ok := digestIndex[digestType+":"+digestValue]
+	return ok && knownSize == size
+}
+
+func noteDigest(digestType, digestValue string, size int64) {
+	digestMutex.Lock()
+	defer digestMutex.Unlock()
+	digestIndex[digestType+":"+digestValue] = size
+}
+
+// loadDigestIndex walks the existing blobs/<type>/xx/yy/<value> tree
+// under --dest and records what's already there, so a restart doesn't
+// need to re-fetch (or even re-HEAD) anything already backed up.
+func loadDigestIndex() {
+	for _, digestType := range []string{"sha1", "md5"} {
+		walkDigestDir(digestType, fmt.Sprintf("%s/%s", blobsDir(), digestType))
+	}
+}
+
+func walkDigestDir(digestType, dir string) {
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return // nothing backed up yet under this digest type
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		sub := dir + "/" + name
+		fi, err := os.Stat(sub)
+		if err != nil {
+			continue
+		}
+		if fi.IsDirectory() {
+			walkDigestDir(digestType, sub)
+			continue
+		}
+		noteDigest(digestType, name, fi.Size)
+	}
+}
+
+// classifiedGet makes one rate-limited attempt at url and sorts the
+// outcome into: a usable response; a permanent failure (404/410, or
+// any other 4xx except 429, which the caller should record as "gone"
+// and never retry); or a
+// transient failure (network error, 429, 5xx), optionally carrying
+// the server's requested Retry-After in seconds.  status is the HTTP
+// status code that produced the outcome, or 0 for a network error
+// that never got a response, so callers can populate FetchError.Status
+// instead of hardcoding 0.
+func classifiedGet(url string) (res *http.Response, status int, permanent bool, retryAfter int64, errMsg string) {
+	if rl := rateLimiterForHost(url); rl != nil {
+		rl.Wait()
+	}
+	r, _, err := http.Get(url)
+	if err != nil {
+		return nil, 0, false, 0, fmt.Sprintf("%v", err)
+	}
+	switch {
+	case r.StatusCode == 404 || r.StatusCode == 410:
+		r.Body.Close()
+		return nil, r.StatusCode, true, 0, fmt.Sprintf("HTTP %d", r.StatusCode)
+	case r.StatusCode == 429 || r.StatusCode >= 500:
+		after := parseRetryAfter(r.Header.Get("Retry-After"))
+		r.Body.Close()
+		return nil, r.StatusCode, false, after, fmt.Sprintf("HTTP %d", r.StatusCode)
+	case r.StatusCode >= 400:
+		r.Body.Close()
+		return nil, r.StatusCode, true, 0, fmt.Sprintf("HTTP %d", r.StatusCode)
+	}
+	return r, r.StatusCode, false, 0, ""
+}
+
+// fetchBlobToCAS makes a single attempt at downloading url into the
+// content-addressable store, verifying it against digestType/
+// digestValue and expectedSize as it streams in.  ok is true only if
+// the blob is now correctly in place; permanent is true if the
+// caller should give up on this URL rather than retry it.
+func fetchBlobToCAS(url, digestType, digestValue string, expectedSize int64) (dest string, ok, permanent bool, retryAfter int64) {
+	dest = casPath(digestType, digestValue)
+	if digestKnown(digestType, digestValue, expectedSize) {
+		if fi, err := os.Stat(dest); err == nil && fi.Size == expectedSize {
+			return dest, true, false, 0
+		}
 	}
 
 	netop := NewNetworkOperation()
 	defer netop.Done()
 
-	res, _, err := http.Get(url)
-	if err != nil {
-		addError(fmt.Sprintf("Error fetching %s: %v", url, err))
-		return false
+	res, status, permanent, retryAfter, errMsg := classifiedGet(url)
+	if res == nil {
+		addTransientFetchError(url, status, 1, errMsg)
+		return "", false, permanent, retryAfter
 	}
 	defer res.Body.Close()
 
-	fileBytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		addError(fmt.Sprintf("Error reading XML from %s: %v", url, err))
-		return false
+	hasher := newDigestHash(digestType)
+	if hasher == nil {
+		addError(fmt.Sprintf("Unknown digest type %q for %s", digestType, url))
+		return "", false, true, 0
+	}
+
+	if err := os.MkdirAll(dir(dest), 0755); err != nil {
+		addError(fmt.Sprintf("Error creating %s: %v", dir(dest), err))
+		return "", false, false, 0
 	}
 
-	err = ioutil.WriteFile(filename, fileBytes, 0600)
+	tmpName := dest + ".tmp"
+	f, err := os.Open(tmpName, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+	if err != nil {
+		addError(fmt.Sprintf("Error creating %s: %v", tmpName, err))
+		return "", false, false, 0
+	}
+	xferId := beginTransfer(url, expectedSize)
+	defer endTransfer(xferId)
+	size, err := io.Copy(io.MultiWriter(f, hasher), &progressReader{res.Body, xferId})
+	f.Close()
 	if err != nil {
-		addError(fmt.Sprintf("Error writing file %s: %v", filename, err))
+		os.Remove(tmpName)
+		addTransientFetchError(url, status, 1, fmt.Sprintf("%v", err))
+		return "", false, false, 0
+	}
+
+	gotDigest := fmt.Sprintf("%x", hasher.Sum())
+	if gotDigest != digestValue || (expectedSize >= 0 && size != expectedSize) {
+		os.Remove(tmpName)
+		addError(fmt.Sprintf("Digest/size mismatch for %s: got %s (%d bytes), want %s (%d bytes)",
+			url, gotDigest, size, digestValue, expectedSize))
+		return "", false, false, 0
+	}
+
+	if err := os.Rename(tmpName, dest); err != nil {
+		addError(fmt.Sprintf("Error committing %s: %v", dest, err))
+		return "", false, false, 0
+	}
+	noteDigest(digestType, digestValue, size)
+	return dest, true, false, 0
+}
+
+// linkFromCAS makes filename refer to the already-verified CAS blob
+// at casFilename, preferring a hardlink (free, same filesystem) and
+// falling back to a symlink across devices.
+func linkFromCAS(casFilename, filename string) bool {
+	os.Remove(filename) // in case of a stale copy from an older run
+	if err := os.Link(casFilename, filename); err == nil {
+		return true
+	}
+	if err := os.Symlink(casFilename, filename); err != nil {
+		addError(fmt.Sprintf("Error linking %s to %s: %v", filename, casFilename, err))
 		return false
 	}
 	return true
 }
 
+// dir returns the parent directory of path.
+func dir(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			return path[0:i]
+		}
+	}
+	return "."
+}
+
+// fetchUrlToFile makes a single attempt at downloading url to
+// filename, unless lastFetched (a manifest-recorded unix timestamp,
+// or 0 if never fetched) is still fresh per --refresh and filename
+// already matches expectedSize (-1 meaning "any non-empty file").
+// Writes go through a ".tmp" sibling and an atomic rename, so a crash
+// mid-download never leaves a file that looks complete but isn't.
+// ok is true only if the file is now correctly in place; permanent is
+// true if the caller should give up on this URL rather than retry it.
+func fetchUrlToFile(url, filename string, expectedSize, lastFetched int64) (ok, permanent bool, retryAfter int64) {
+	if freshEnough(lastFetched) {
+		if fi, err := os.Stat(filename); err == nil &&
+			(expectedSize == -1 && fi.Size > 0 ||
+				expectedSize == fi.Size) {
+			return true, false, 0
+		}
+	}
+
+	netop := NewNetworkOperation()
+	defer netop.Done()
+
+	res, status, permanent, retryAfter, errMsg := classifiedGet(url)
+	if res == nil {
+		addTransientFetchError(url, status, 1, errMsg)
+		return false, permanent, retryAfter
+	}
+	defer res.Body.Close()
+
+	tmpName := filename + ".tmp"
+	f, err := os.Open(tmpName, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+	if err != nil {
+		addError(fmt.Sprintf("Error creating %s: %v", tmpName, err))
+		return false, false, 0
+	}
+	xferId := beginTransfer(url, expectedSize)
+	_, err = io.Copy(f, &progressReader{res.Body, xferId})
+	endTransfer(xferId)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		addTransientFetchError(url, status, 1, fmt.Sprintf("%v", err))
+		return false, false, 0
+	}
+
+	if err := os.Rename(tmpName, filename); err != nil {
+		addError(fmt.Sprintf("Error committing file %s: %v", filename, err))
+		return false, false, 0
+	}
+	return true, false, 0
+}
+
 type Gallery struct {
 	key string
 }
@@ -157,12 +1068,46 @@ func (g *Gallery) XmlUrl() string {
 }
 
 func (g *Gallery) Fetch(op Operation) {
-	defer op.Done()
+	g.tryFetch(op, 1)
+}
 
+// tryFetch makes one attempt (the given 1-based attempt number) at
+// fetching g's XML, scheduling a backed-off retry via op.Retry() if
+// the failure looks transient and --max-retries hasn't been reached.
+func (g *Gallery) tryFetch(op Operation, attempt int) {
 	galXmlFilename := fmt.Sprintf("%s/gallery-%s.xml", *flagDest, g.key)
-	if fetchUrlToFile(g.XmlUrl(), galXmlFilename, -1) {
-		go fetchPhotosInGallery(galXmlFilename, NewLocalOperation())
+	ok, permanent, retryAfter := fetchUrlToFile(g.XmlUrl(), galXmlFilename, -1, galleryLastFetched(g.key))
+	if ok {
+		op.Done()
+		decBacklog()
+		endGalleryFetch(g.key)
+		noteGalleryFetched(g.key, g.XmlUrl())
+		go fetchPhotosInGallery(g.key, galXmlFilename, NewLocalOperation())
+		return
+	}
+	if permanent {
+		op.Done()
+		decBacklog()
+		endGalleryFetch(g.key)
+		markGalleryGone(g.key)
+		return
+	}
+	if attempt >= *flagMaxRetries {
+		op.Done()
+		decBacklog()
+		endGalleryFetch(g.key)
+		addFetchError(g.XmlUrl(), 0, attempt, "giving up after max retries")
+		return
+	}
+	delay := backoffDelay(attempt)
+	if retryAfter > 0 && retryAfter*1e9 > delay {
+		delay = retryAfter * 1e9
 	}
+	op.Done()
+	go func() {
+		time.Sleep(delay)
+		g.tryFetch(op.Retry(), attempt+1)
+	}()
 }
 
 type DigestInfo struct {
@@ -218,15 +1163,127 @@ func (p *MediaSetItem) BlobBackupFilename() string {
 }
 
 func (p *MediaSetItem) Fetch(op Operation) {
-	defer op.Done()
-	if !fetchUrlToFile(p.XmlUrl(), p.XmlBackupFilename(), -1) {
+	p.tryFetchXml(op, 1)
+}
+
+// tryFetchXml makes one attempt at fetching p's XML, then hands off
+// to tryFetchBlob once it succeeds.  notePicFetched only fires once
+// tryFetchBlob confirms the blob itself is in place, since that's the
+// only signal that tells a later scan "this pic is done, don't
+// refetch" (see picLastFetched/freshEnough); firing it here would
+// mark a pic as fresh forever if the blob download never finishes.
+func (p *MediaSetItem) tryFetchXml(op Operation, attempt int) {
+	ok, permanent, retryAfter := fetchUrlToFile(p.XmlUrl(), p.XmlBackupFilename(), -1, picLastFetched(p.key))
+	if ok {
+		p.tryFetchBlob(op, 1)
+		return
+	}
+	if permanent {
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		markPicGone(p.key)
+		return
+	}
+	if attempt >= *flagMaxRetries {
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		addFetchError(p.XmlUrl(), 0, attempt, "giving up after max retries")
 		return
 	}
+	delay := backoffDelay(attempt)
+	if retryAfter > 0 && retryAfter*1e9 > delay {
+		delay = retryAfter * 1e9
+	}
+	op.Done()
+	go func() {
+		time.Sleep(delay)
+		p.tryFetchXml(op.Retry(), attempt+1)
+	}()
+}
 
+// parsePicXmlFile parses a pic's own backed-up XML (the same
+// <mediaSetItem> schema used inside a gallery's XML) back into a
+// *MediaSetItem, so a manifest-resumed stub that's missing File
+// details (its blob never finished downloading in a prior run) can
+// recover them without a network round-trip.
+func parsePicXmlFile(filename string) (*MediaSetItem, os.Error) {
+	f, err := os.Open(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	item := new(MediaSetItem)
+	if err := xml.Unmarshal(f, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// tryFetchBlob makes one attempt at fetching p's blob into the CAS
+// and linking it into place, retrying with backoff like tryFetchXml.
+func (p *MediaSetItem) tryFetchBlob(op Operation, attempt int) {
 	if p.File.Bytes <= 0 {
-		panic("expected file to have some known file size")
+		// A manifest-resumed stub (see loadManifest) has no File info
+		// until its gallery gets re-crawled; reparse the XML
+		// tryFetchXml just confirmed is on disk instead of assuming
+		// p.File is already populated.
+		if item, err := parsePicXmlFile(p.XmlBackupFilename()); err == nil {
+			p.Title = item.Title
+			p.Description = item.Description
+			p.File = item.File
+		}
+	}
+	if p.File.Bytes <= 0 {
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		addFetchError(p.XmlUrl(), 0, attempt, "no usable file size after parsing XML; giving up")
+		return
+	}
+
+	blobFilename := p.BlobBackupFilename()
+	if fi, err := os.Lstat(blobFilename); err == nil && fi.Size == p.File.Bytes {
+		notePicFetched(p)
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		return
+	}
+
+	casFilename, ok, permanent, retryAfter := fetchBlobToCAS(p.BlobUrl(), p.File.Digest.Type, p.File.Digest.Value, p.File.Bytes)
+	if ok {
+		linkFromCAS(casFilename, blobFilename)
+		notePicFetched(p)
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		return
+	}
+	if permanent {
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		markPicGone(p.key)
+		return
+	}
+	if attempt >= *flagMaxRetries {
+		op.Done()
+		decBacklog()
+		endPicFetch(p.key)
+		addFetchError(p.BlobUrl(), 0, attempt, "giving up after max retries")
+		return
 	}
-	fetchUrlToFile(p.BlobUrl(), p.BlobBackupFilename(), p.File.Bytes)
+	delay := backoffDelay(attempt)
+	if retryAfter > 0 && retryAfter*1e9 > delay {
+		delay = retryAfter * 1e9
+	}
+	op.Done()
+	go func() {
+		time.Sleep(delay)
+		p.tryFetchBlob(op.Retry(), attempt+1)
+	}()
 }
 
 type MediaSetItemsWrapper struct {
@@ -246,12 +1303,13 @@ type LinkedToSet struct {
 
 type MediaSet struct {
 	XMLName       xml.Name "mediaSet"
+	Title         string
 	MediaSetItems MediaSetItemsWrapper
 	LinkedFrom    LinkedFromSet
 	LinkedTo      LinkedToSet
 }
 
-func fetchPhotosInGallery(filename string, op Operation) {
+func fetchPhotosInGallery(key, filename string, op Operation) {
 	defer op.Done()
 
 	f, err := os.Open(filename, os.O_RDONLY, 0)
@@ -267,6 +1325,14 @@ func fetchPhotosInGallery(filename string, op Operation) {
 		return
 	}
 
+	// Now that we know the gallery's title, re-check it against
+	// --include-gallery/--exclude-gallery: the key-only check in
+	// noteGallery can't see this until the XML is actually fetched.
+	if !galleryAllowed(key, mediaSet.Title) {
+		markGalleryExcluded(key, "")
+		return
+	}
+
 	// Learn about new galleries, potentially?
 	for _, url := range mediaSet.LinkedFrom.InfoURL {
 		noteGallery(url)
@@ -274,9 +1340,11 @@ func fetchPhotosInGallery(filename string, op Operation) {
 	for _, url := range mediaSet.LinkedTo.InfoURL {
 		noteGallery(url)
 	}
+	noteGalleryLinks(key, mediaSet.LinkedFrom.InfoURL, mediaSet.LinkedTo.InfoURL)
 
 	//log.Printf("Parse of %s is: %q", filename, mediaSet)
 	for _, item := range mediaSet.MediaSetItems.MediaSetItem {
+		item := item // don't alias the range variable; notePhoto keeps the pointer
 		item.key = findKey(item.InfoURL, picPattern)
 		//log.Printf("   pic: %s", item.InfoURL)
 		notePhoto(&item)
@@ -289,6 +1357,52 @@ func knownGalleries() int {
 	return len(galleryMap)
 }
 
+func knownPics() int {
+	picMutex.Lock()
+	defer picMutex.Unlock()
+	return len(picMap)
+}
+
+// startGalleryFetch reports whether key has no Gallery.Fetch already in
+// flight and, if so, atomically marks it as in flight.  Callers that
+// get false must not launch a fetch for key.
+func startGalleryFetch(key string) bool {
+	galleryMutex.Lock()
+	defer galleryMutex.Unlock()
+	if galleryFetching[key] {
+		return false
+	}
+	galleryFetching[key] = true
+	return true
+}
+
+// endGalleryFetch marks key's Gallery.Fetch as finished (for good: a
+// permanent failure, final giving-up, or success), allowing a later
+// noteGallery/apiRetry to launch another one.
+func endGalleryFetch(key string) {
+	galleryMutex.Lock()
+	galleryFetching[key] = false, false
+	galleryMutex.Unlock()
+}
+
+// startPicFetch/endPicFetch are startGalleryFetch/endGalleryFetch's
+// pic-side counterparts.
+func startPicFetch(key string) bool {
+	picMutex.Lock()
+	defer picMutex.Unlock()
+	if picFetching[key] {
+		return false
+	}
+	picFetching[key] = true
+	return true
+}
+
+func endPicFetch(key string) {
+	picMutex.Lock()
+	picFetching[key] = false, false
+	picMutex.Unlock()
+}
+
 func findKey(keyOrUrl string, pattern *regexp.Regexp) string {
 	if len(keyOrUrl) == 8 {
 		return keyOrUrl
@@ -307,35 +1421,85 @@ func findKey(keyOrUrl string, pattern *regexp.Regexp) string {
 func noteGallery(keyOrUrl string) {
 	key := findKey(keyOrUrl, galleryPattern)
 	galleryMutex.Lock()
-	defer galleryMutex.Unlock()
-	if _, known := galleryMap[key]; known {
+	gallery, known := galleryMap[key]
+	if !known {
+		gallery = &Gallery{key}
+		galleryMap[key] = gallery
+	}
+	galleryMutex.Unlock()
+
+	if galleryGone(key) {
+		return
+	}
+
+	if !galleryAllowed(key, "") {
+		markGalleryExcluded(key, gallery.XmlUrl())
+		return
+	}
+
+	// A gallery already marked excluded by its title (only knowable
+	// once its XML is fetched) is still worth reprocessing locally:
+	// fetchUrlToFile below will reuse the already-fetched file rather
+	// than re-crawling, and fetchPhotosInGallery will re-check the
+	// filters in case they've since changed.
+	if freshEnough(galleryLastFetched(key)) && !galleryExcluded(key) {
 		return
 	}
-	gallery := &Gallery{key}
-	galleryMap[key] = gallery
-	log.Printf("Gallery: %s", gallery.XmlUrl())
+	if !startGalleryFetch(key) {
+		return // already being fetched by another goroutine
+	}
+	if *flagQuiet {
+		log.Printf("Gallery: %s", gallery.XmlUrl())
+	}
+	incBacklog()
 	go gallery.Fetch(NewLocalOperation())
 }
 
+// notePhoto records a freshly-parsed pic, always replacing any
+// existing *MediaSetItem for its key rather than mutating it in
+// place: a fetch goroutine for an older pointer may be reading its
+// File field concurrently, without picMutex held.
 func notePhoto(pic *MediaSetItem) {
 	picMutex.Lock()
-	defer picMutex.Unlock()
-	if _, known := picMap[pic.key]; known {
+	picMap[pic.key] = pic
+	picMutex.Unlock()
+	existing := pic
+
+	if picGone(pic.key) {
 		return
 	}
-	picMap[pic.key] = pic
-	log.Printf("Photo: %s", pic.XmlUrl())
-	go pic.Fetch(NewLocalOperation())
+
+	if !picAllowed(existing.File.Mime, existing.File.Bytes) {
+		markPicExcluded(existing)
+		return
+	}
+
+	if freshEnough(picLastFetched(pic.key)) {
+		return
+	}
+	if !startPicFetch(pic.key) {
+		return // already being fetched by another goroutine
+	}
+	if *flagQuiet {
+		log.Printf("Photo: %s", existing.XmlUrl())
+	}
+	incBacklog()
+	go existing.Fetch(NewLocalOperation())
 }
 
 func fetchGalleryPage(page int) {
-	log.Printf("Fetching gallery page %d", page)
+	setCurrentPage(page)
+	if *flagQuiet {
+		log.Printf("Fetching gallery page %d", page)
+	}
 	res, finalUrl, err := http.Get(fmt.Sprintf("%s/?sort=alpha&page=%d",
 		*flagBase, page))
 	if err != nil {
 		log.Exitf("Error fetching gallery page %d: %v", page, err)
 	}
-	log.Printf("Fetched page %d: %s", page, finalUrl)
+	if *flagQuiet {
+		log.Printf("Fetched page %d: %s", page, finalUrl)
+	}
 	htmlBytes, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.Exitf("Error reading gallery page %d's HTML: %v", page, err)
@@ -343,7 +1507,9 @@ func fetchGalleryPage(page int) {
 	res.Body.Close()
 
 	html := string(htmlBytes)
-	log.Printf("read %d bytes", len(html))
+	if *flagQuiet {
+		log.Printf("read %d bytes", len(html))
+	}
 
 	matches := galleryPattern.FindAllStringSubmatch(html, -1)
 	for _, match := range matches {
@@ -361,23 +1527,40 @@ func main() {
 		log.Exitf("No --base URL given.")
 	}
 
+	includeGalleryList = newNameList(*flagIncludeGallery)
+	excludeGalleryList = newNameList(*flagExcludeGallery)
+	includeMimeList = newNameList(*flagIncludeMime)
+
 	networkOpGate = make(chan bool, *flagMaxNetwork)
 
 	log.Printf("Starting.")
+	loadDigestIndex()
+	log.Printf("%d known blob(s) in %s", len(digestIndex), blobsDir())
+	loadManifest()
+	log.Printf("Manifest: %d known gallery(s), %d known pic(s)", len(manifest.Galleries), len(manifest.Pics))
 
 	if *flagProfile != "" {
 		log.Printf("Listening on http://%s", *flagProfile)
+		startControlApi()
 		go http.ListenAndServe(*flagProfile, nil)
 	}
 
+	if !*flagQuiet {
+		go progressLoop()
+	}
+
 	page := 1
 	for {
 		countBefore := knownGalleries()
 		fetchGalleryPage(page)
 		countAfter := knownGalleries()
-		log.Printf("Galleries known: %d", countAfter)
+		if *flagQuiet {
+			log.Printf("Galleries known: %d", countAfter)
+		}
 		if countAfter == countBefore {
-			log.Printf("No new galleries, stopping.")
+			if *flagQuiet {
+				log.Printf("No new galleries, stopping.")
+			}
 			break
 		}
 		page++
@@ -388,7 +1571,9 @@ func main() {
 		if n == 0 {
 			break
 		}
-		log.Printf("%d Operations in-flight.  Waiting.", n)
+		if *flagQuiet {
+			log.Printf("%d Operations in-flight.  Waiting.", n)
+		}
 		time.Sleep(5 * 1e9)
 	}
 	log.Printf("Done.")
@@ -0,0 +1,46 @@
+// Copyright 2010 Brad Fitzpatrick. All rights reserved. See LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"30", 30},
+		{"30s", 30},
+		{"5m", 300},
+		{"2h", 7200},
+		{"1d", 86400},
+	}
+	for _, c := range cases {
+		if got := parseDuration(c.in); got != c.want {
+			t.Errorf("parseDuration(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestBackoffDelayCapped(t *testing.T) {
+	const max = int64(60 * 1e9)
+	// A large attempt number overflows the bit shift in backoffDelay;
+	// it must still come back capped at max, not negative or huge.
+	for _, attempt := range []int{1, 5, 10, 30, 100} {
+		d := backoffDelay(attempt)
+		if d <= 0 || d > max {
+			t.Errorf("backoffDelay(%d) = %d, want in (0, %d]", attempt, d, max)
+		}
+	}
+}
+
+func TestBackoffDelayGrows(t *testing.T) {
+	// Not strictly monotonic (it's jittered), but attempt 10 should
+	// never come back smaller than attempt 1's minimum possible delay.
+	const min1 = int64(250 * 1e6) // half of backoffDelay(1)'s base
+	d := backoffDelay(10)
+	if d < min1 {
+		t.Errorf("backoffDelay(10) = %d, want >= %d", d, min1)
+	}
+}
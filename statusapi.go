@@ -0,0 +1,185 @@
+// Copyright 2010 Brad Fitzpatrick. All rights reserved. See LICENSE file.
+//
+// statusapi.go adds a few small JSON endpoints to the --profile
+// listener, alongside the net/http/pprof handlers it already serves.
+// It's its own file (and keeps its own tiny router) so the same
+// routes can later grow real per-route auth when this tool is run as
+// a long-lived mirror daemon instead of a one-shot command.
+
+package main
+
+import (
+	"fmt"
+	"http"
+	"json"
+	"strconv"
+	"strings"
+)
+
+// AuthFunc authorizes a request before its handler runs.  allowAll is
+// the default; a daemon deployment can swap in a real check per
+// route without touching the routing below.
+type AuthFunc func(req *http.Request) bool
+
+func allowAll(req *http.Request) bool { return true }
+
+type apiRoute struct {
+	method  string
+	pattern string // exact match, unless it ends in "/" for a prefix match
+	auth    AuthFunc
+	handler http.HandlerFunc
+}
+
+// apiRouter is a minimal method+path router: just enough for the
+// handful of fixed and prefix routes below.
+type apiRouter struct {
+	routes []apiRoute
+}
+
+func newApiRouter() *apiRouter {
+	return &apiRouter{}
+}
+
+func (ar *apiRouter) handle(method, pattern string, auth AuthFunc, handler http.HandlerFunc) {
+	if auth == nil {
+		auth = allowAll
+	}
+	ar.routes = append(ar.routes, apiRoute{method, pattern, auth, handler})
+}
+
+func (ar *apiRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, route := range ar.routes {
+		if req.Method != route.method {
+			continue
+		}
+		if strings.HasSuffix(route.pattern, "/") {
+			if !strings.HasPrefix(req.URL.Path, route.pattern) {
+				continue
+			}
+		} else if req.URL.Path != route.pattern {
+			continue
+		}
+		if !route.auth(req) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		route.handler(w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+type statusResponse struct {
+	GalleriesKnown     int
+	PicsKnown          int
+	OperationsInFlight int
+	BytesDownloaded    int64
+	BytesTotal         int64
+	RecentErrors       []FetchError
+}
+
+func apiStatus(w http.ResponseWriter, req *http.Request) {
+	errorMutex.Lock()
+	recent := errors
+	if len(recent) > 10 {
+		recent = recent[len(recent)-10:]
+	}
+	errorMutex.Unlock()
+
+	writeJson(w, statusResponse{
+		GalleriesKnown:     knownGalleries(),
+		PicsKnown:          knownPics(),
+		OperationsInFlight: OperationsInFlight(),
+		BytesDownloaded:    getBytesDone(),
+		BytesTotal:         bytesTotal(),
+		RecentErrors:       recent,
+	})
+}
+
+func apiErrors(w http.ResponseWriter, req *http.Request) {
+	errorMutex.Lock()
+	defer errorMutex.Unlock()
+	writeJson(w, errors)
+}
+
+// apiRetry re-queues every gallery and pic that hasn't successfully
+// finished yet (not fresh per freshEnough and not already in flight),
+// whether or not it has an entry in errors.  galleryGone/picGone
+// entries are skipped: those got a permanent error and are never
+// retried, no matter how many times this is called.
+func apiRetry(w http.ResponseWriter, req *http.Request) {
+	retried := 0
+
+	galleryMutex.Lock()
+	for key, g := range galleryMap {
+		if galleryGone(key) || galleryFetching[key] || freshEnough(galleryLastFetched(key)) {
+			continue
+		}
+		galleryFetching[key] = true
+		retried++
+		incBacklog()
+		go g.Fetch(NewLocalOperation())
+	}
+	galleryMutex.Unlock()
+
+	picMutex.Lock()
+	for key, p := range picMap {
+		if picGone(key) || picFetching[key] || freshEnough(picLastFetched(key)) {
+			continue
+		}
+		picFetching[key] = true
+		retried++
+		incBacklog()
+		go p.Fetch(NewLocalOperation())
+	}
+	picMutex.Unlock()
+
+	writeJson(w, map[string]int{"retried": retried})
+}
+
+func apiConcurrency(w http.ResponseWriter, req *http.Request) {
+	n, err := strconv.Atoi(req.FormValue("n"))
+	if err != nil || n <= 0 {
+		http.Error(w, "bad n", http.StatusBadRequest)
+		return
+	}
+	resizeNetworkConcurrency(n)
+	writeJson(w, map[string]int{"concurrency": n})
+}
+
+func apiInjectGallery(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Path[len("/gallery/"):]
+	if key == "" {
+		http.Error(w, "missing gallery key", http.StatusBadRequest)
+		return
+	}
+	noteGallery(key)
+	writeJson(w, map[string]string{"gallery": key})
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// startControlApi wires the JSON control endpoints into the same
+// listener --profile already uses for net/http/pprof.
+func startControlApi() {
+	router := newApiRouter()
+	router.handle("GET", "/status", nil, apiStatus)
+	router.handle("GET", "/errors", nil, apiErrors)
+	router.handle("POST", "/retry", nil, apiRetry)
+	router.handle("POST", "/concurrency", nil, apiConcurrency)
+	router.handle("POST", "/gallery/", nil, apiInjectGallery)
+
+	http.Handle("/status", router)
+	http.Handle("/errors", router)
+	http.Handle("/retry", router)
+	http.Handle("/concurrency", router)
+	http.Handle("/gallery/", router)
+}